@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultDaemonInterval is how often the daemon advances every tracked
+// marquee's scroll position when --interval isn't given. It matches the
+// one-tick-per-invocation cadence of the one-shot CLI mode.
+const defaultDaemonInterval = 1 * time.Second
+
+func defaultSocketPath() string {
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		return filepath.Join(d, "tmux-marquee", "sock")
+	}
+	return filepath.Join(stateDirectory(), "sock")
+}
+
+// wireRequest is the message a --client invocation sends to the daemon.
+// Width carries the same spec accepted by -w/--width (a column count, a
+// percentage, or a tmux format string); the daemon resolves and caches it
+// per id exactly as the one-shot CLI does. Pane carries the client's own
+// $TMUX_PANE so a percentage/tmux-format width is resolved against the
+// pane actually issuing this tick, not whatever pane happened to
+// auto-spawn the daemon.
+type wireRequest struct {
+	ID           string `json:"id"`
+	Width        string `json:"width"`
+	WidthReserve int    `json:"widthReserve,omitempty"`
+	Pane         string `json:"pane,omitempty"`
+	Speed        int    `json:"speed"`
+	Separator    string `json:"separator"`
+	Direction    string `json:"direction"`
+	Pad          bool   `json:"pad"`
+	ScrollDelay  int    `json:"scrollDelay"`
+	MaxLength    int    `json:"maxLength"`
+	Normalize    bool   `json:"normalize"`
+	Output       string `json:"output,omitempty"`
+	Text         string `json:"text"`
+	Ping         bool   `json:"ping,omitempty"`
+	Stop         bool   `json:"stop,omitempty"`
+}
+
+type wireResponse struct {
+	Visible string `json:"visible"`
+	Ok      bool   `json:"ok"`
+}
+
+// writeFrame and readFrame implement a tiny self-describing wire framing:
+// a varint byte length followed by that many bytes of JSON. Using a varint
+// length rather than a fixed JSON-lines protocol lets the payload grow
+// (new fields, binary-ish separators) without changing the framing.
+func writeFrame(w io.Writer, payload []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(payload)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// marqueeEntry is one --id's worth of daemon-resident state. render is
+// called under mu both by the daemon's own ticker and, once per new tick's
+// worth of text, eagerly from handleConn so a changed source doesn't wait
+// for the next tick to show up.
+type marqueeEntry struct {
+	mu      sync.Mutex
+	opts    opts
+	text    string
+	seen    bool
+	st      state
+	visible string
+}
+
+func (e *marqueeEntry) render() {
+	e.visible, e.st = Render(e.opts, e.text, e.st)
+}
+
+type daemonServer struct {
+	mu       sync.Mutex
+	entries  map[string]*marqueeEntry
+	stateDir string
+}
+
+func newDaemonServer(stateDir string) *daemonServer {
+	return &daemonServer{entries: make(map[string]*marqueeEntry), stateDir: stateDir}
+}
+
+func (d *daemonServer) entry(id string) *marqueeEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.entries[id]
+	if !ok {
+		e = &marqueeEntry{}
+		d.entries[id] = e
+	}
+	return e
+}
+
+// preload seeds entries from the on-disk state files left by a previous
+// daemon run or by one-shot invocations, so scroll position survives a
+// daemon restart.
+func (d *daemonServer) preload() {
+	files, err := os.ReadDir(d.stateDir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.Contains(f.Name(), ".tmp.") || f.Name() == "sock" {
+			continue
+		}
+		st := readState(filepath.Join(d.stateDir, f.Name()))
+		if st.hash == "" {
+			continue
+		}
+		d.entries[f.Name()] = &marqueeEntry{st: st}
+	}
+}
+
+// flush writes every entry's state to disk. Per-tick state otherwise only
+// lives in memory, so this is what makes a daemon restart resume scrolling
+// from roughly where it left off.
+func (d *daemonServer) flush() {
+	_ = os.MkdirAll(d.stateDir, 0o700)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, e := range d.entries {
+		e.mu.Lock()
+		writeState(filepath.Join(d.stateDir, id), e.st)
+		e.mu.Unlock()
+	}
+}
+
+// tick advances every tracked marquee on its own schedule, independent of
+// how often (or how rarely) a --client invocation actually polls it. This
+// is what lets --speed/--interval move faster than tmux's status-interval.
+func (d *daemonServer) tick(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		d.mu.Lock()
+		entries := make([]*marqueeEntry, 0, len(d.entries))
+		for _, e := range d.entries {
+			entries = append(entries, e)
+		}
+		d.mu.Unlock()
+
+		for _, e := range entries {
+			e.mu.Lock()
+			if e.seen {
+				e.render()
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+func (d *daemonServer) handleConn(conn net.Conn, onStop func()) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	payload, err := readFrame(br)
+	if err != nil {
+		return
+	}
+	var req wireRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return
+	}
+
+	if req.Stop {
+		respond(conn, wireResponse{Ok: true})
+		onStop()
+		return
+	}
+	if req.Ping {
+		respond(conn, wireResponse{Ok: true})
+		return
+	}
+
+	e := d.entry(req.ID)
+	e.mu.Lock()
+	e.opts = opts{
+		width:        req.Width,
+		widthReserve: req.WidthReserve,
+		tmuxPane:     req.Pane,
+		speed:        req.Speed,
+		separator:    req.Separator,
+		direction:    req.Direction,
+		pad:          req.Pad,
+		scrollDelay:  req.ScrollDelay,
+		maxLength:    req.MaxLength,
+		normalize:    req.Normalize,
+		output:       req.Output,
+	}
+	if req.Text != e.text || !e.seen {
+		e.text = req.Text
+		e.seen = true
+		e.render()
+	}
+	visible := e.visible
+	e.mu.Unlock()
+
+	respond(conn, wireResponse{Visible: visible, Ok: true})
+}
+
+func respond(conn net.Conn, resp wireResponse) {
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	_ = writeFrame(conn, payload)
+}
+
+// runDaemon starts the long-lived process a --client invocation talks to.
+// It owns the Unix socket at o.socketPath until it receives --daemon-stop
+// or a termination signal, at which point it flushes in-memory state to
+// disk and exits.
+func runDaemon(o opts) {
+	_ = os.MkdirAll(filepath.Dir(o.socketPath), 0o700)
+	os.Remove(o.socketPath) // clear a stale socket left by a crashed daemon
+
+	ln, err := net.Listen("unix", o.socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tmux-marquee: daemon: %v\n", err)
+		os.Exit(1)
+	}
+
+	d := newDaemonServer(stateDirectory())
+	d.preload()
+
+	interval := o.daemonInterval
+	if interval <= 0 {
+		interval = defaultDaemonInterval
+	}
+	go d.tick(interval)
+
+	shutdown := func() {
+		ln.Close()
+		d.flush()
+		os.Remove(o.socketPath)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		shutdown()
+		os.Exit(0)
+	}()
+
+	stopOnce := sync.Once{}
+	onStop := func() {
+		stopOnce.Do(func() {
+			shutdown()
+			os.Exit(0)
+		})
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go d.handleConn(conn, onStop)
+	}
+}
+
+// runClient forwards one tick's text to the daemon at o.socketPath,
+// spawning it first if it isn't reachable, and prints the visible slice
+// the daemon returns.
+func runClient(o opts) {
+	raw, _ := io.ReadAll(os.Stdin)
+	text := strings.TrimRight(string(raw), "\n")
+
+	conn, err := dialDaemon(o.socketPath)
+	if err != nil {
+		if !spawnDaemon(o) {
+			fmt.Fprintf(os.Stderr, "tmux-marquee: daemon not running and could not be started\n")
+			os.Exit(1)
+		}
+		conn, err = dialDaemon(o.socketPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tmux-marquee: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	defer conn.Close()
+
+	req := wireRequest{
+		ID:           o.id,
+		Width:        o.width,
+		WidthReserve: o.widthReserve,
+		Pane:         o.tmuxPane,
+		Speed:        o.speed,
+		Separator:    o.separator,
+		Direction:    o.direction,
+		Pad:          o.pad,
+		ScrollDelay:  o.scrollDelay,
+		MaxLength:    o.maxLength,
+		Normalize:    o.normalize,
+		Output:       o.output,
+		Text:         text,
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tmux-marquee: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeFrame(conn, payload); err != nil {
+		fmt.Fprintf(os.Stderr, "tmux-marquee: %v\n", err)
+		os.Exit(1)
+	}
+
+	respPayload, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tmux-marquee: %v\n", err)
+		os.Exit(1)
+	}
+	var resp wireResponse
+	if err := json.Unmarshal(respPayload, &resp); err != nil {
+		fmt.Fprintf(os.Stderr, "tmux-marquee: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(resp.Visible)
+}
+
+func dialDaemon(socketPath string) (net.Conn, error) {
+	return net.DialTimeout("unix", socketPath, 200*time.Millisecond)
+}
+
+// spawnDaemon forks a detached `tmux-marquee --daemon` using the running
+// binary and waits briefly for its socket to come up.
+func spawnDaemon(o opts) bool {
+	exe, err := os.Executable()
+	if err != nil {
+		exe = os.Args[0]
+	}
+	args := []string{"--daemon", "--socket", o.socketPath}
+	if o.daemonInterval > 0 {
+		args = append(args, "--interval", o.daemonInterval.String())
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = nil
+	if devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0); err == nil {
+		cmd.Stdout = devnull
+		cmd.Stderr = devnull
+	}
+	if err := cmd.Start(); err != nil {
+		return false
+	}
+
+	for i := 0; i < 20; i++ {
+		if conn, err := dialDaemon(o.socketPath); err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+// stopDaemon asks a running daemon to flush its state to disk and exit.
+func stopDaemon(o opts) {
+	conn, err := dialDaemon(o.socketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tmux-marquee: daemon not running")
+		return
+	}
+	defer conn.Close()
+	payload, _ := json.Marshal(wireRequest{Stop: true})
+	_ = writeFrame(conn, payload)
+	_, _ = readFrame(bufio.NewReader(conn))
+}
+
+// printDaemonStatus is the --daemon-status health check: it pings the
+// socket and reports whether a daemon answered.
+func printDaemonStatus(o opts) {
+	conn, err := dialDaemon(o.socketPath)
+	if err != nil {
+		fmt.Println("tmux-marquee: daemon not running")
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	payload, _ := json.Marshal(wireRequest{Ping: true})
+	if err := writeFrame(conn, payload); err != nil {
+		fmt.Println("tmux-marquee: daemon not responding")
+		os.Exit(1)
+	}
+	respPayload, err := readFrame(bufio.NewReader(conn))
+	if err != nil {
+		fmt.Println("tmux-marquee: daemon not responding")
+		os.Exit(1)
+	}
+	var resp wireResponse
+	_ = json.Unmarshal(respPayload, &resp)
+	if !resp.Ok {
+		fmt.Println("tmux-marquee: daemon responded unexpectedly")
+		os.Exit(1)
+	}
+	fmt.Println("tmux-marquee: daemon is running")
+}
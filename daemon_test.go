@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty payload", []byte{}},
+		{"short payload", []byte("hi")},
+		{"json payload", []byte(`{"id":"default","width":"30"}`)},
+		{"payload needing multi-byte varint", bytes.Repeat([]byte("x"), 200)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, tc.payload); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			got, err := readFrame(bufio.NewReader(&buf))
+			if err != nil {
+				t.Fatalf("readFrame: %v", err)
+			}
+			if !bytes.Equal(got, tc.payload) {
+				t.Errorf("readFrame round-trip = %q, want %q", got, tc.payload)
+			}
+		})
+	}
+}
+
+func TestWriteReadFrameMultipleMessages(t *testing.T) {
+	var buf bytes.Buffer
+	msgs := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, m := range msgs {
+		if err := writeFrame(&buf, m); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+
+	r := bufio.NewReader(&buf)
+	for _, want := range msgs {
+		got, err := readFrame(r)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("readFrame = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestReadFrameTruncatedInput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("hello world")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-3]
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(truncated))); err == nil {
+		t.Error("readFrame on truncated input: got nil error, want error")
+	}
+}
@@ -2,53 +2,67 @@ package main
 
 import (
 	"fmt"
-	"hash/crc32"
 	"io"
 	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 	"unicode/utf8"
 
-	"github.com/mattn/go-runewidth"
+	"golang.org/x/text/unicode/norm"
 )
 
 const version = "0.2.0"
 
-type token struct {
-	style bool
-	text  string
-	width int
-}
+// widthCacheTTL bounds how often a percentage or tmux-format width spec
+// re-forks tmux; between ticks the last resolved value is reused.
+const widthCacheTTL = 1 * time.Second
 
 type state struct {
 	hash         string
 	pos          int
 	delayCounter int
+	tmuxVal      int
+	tmuxAt       int64
 }
 
 type opts struct {
-	width      int
-	id         string
-	speed      int
-	separator  string
-	direction  string
-	pad        bool
-	scrollDelay int
-	maxLength  int
-	reset      bool
+	width          string
+	widthReserve   int
+	tmuxPane       string
+	id             string
+	speed          int
+	separator      string
+	direction      string
+	pad            bool
+	scrollDelay    int
+	maxLength      int
+	reset          bool
+	normalize      bool
+	output         string
+	daemon         bool
+	client         bool
+	daemonStop     bool
+	daemonStatus   bool
+	socketPath     string
+	daemonInterval time.Duration
 }
 
 func main() {
 	o := opts{
-		width:     30,
+		width:     "30",
+		tmuxPane:  os.Getenv("TMUX_PANE"),
 		id:        "default",
 		speed:     1,
 		separator: " - ",
 		direction: "left",
 		pad:       true,
+		normalize: true,
+		output:    "tmux",
 	}
 
 	args := os.Args[1:]
@@ -56,7 +70,10 @@ func main() {
 		switch args[i] {
 		case "-w", "--width":
 			i++
-			o.width = mustInt(args[i])
+			o.width = args[i]
+		case "--width-reserve":
+			i++
+			o.widthReserve = mustInt(args[i])
 		case "-i", "--id":
 			i++
 			o.id = args[i]
@@ -81,6 +98,32 @@ func main() {
 			o.maxLength = mustInt(args[i])
 		case "--reset":
 			o.reset = true
+		case "--normalize":
+			o.normalize = true
+		case "--literal":
+			o.normalize = false
+		case "--output":
+			i++
+			o.output = args[i]
+		case "--daemon":
+			o.daemon = true
+		case "--client":
+			o.client = true
+		case "--daemon-stop":
+			o.daemonStop = true
+		case "--daemon-status":
+			o.daemonStatus = true
+		case "--socket":
+			i++
+			o.socketPath = args[i]
+		case "--interval":
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid duration: %s\n", args[i])
+				os.Exit(1)
+			}
+			o.daemonInterval = d
 		case "--help":
 			printUsage()
 			return
@@ -93,6 +136,25 @@ func main() {
 		}
 	}
 
+	if o.socketPath == "" {
+		o.socketPath = defaultSocketPath()
+	}
+
+	switch {
+	case o.daemonStop:
+		stopDaemon(o)
+		return
+	case o.daemonStatus:
+		printDaemonStatus(o)
+		return
+	case o.daemon:
+		runDaemon(o)
+		return
+	case o.client:
+		runClient(o)
+		return
+	}
+
 	stateDir := stateDirectory()
 	_ = os.MkdirAll(stateDir, 0o700)
 	stateFile := filepath.Join(stateDir, o.id)
@@ -109,52 +171,75 @@ func main() {
 
 	raw, _ := io.ReadAll(os.Stdin)
 	text := strings.TrimRight(string(raw), "\n")
-	text = ansiToTmux(text)
 
+	st := readState(stateFile)
+	visible, newSt := Render(o, text, st)
+	if newSt == (state{}) {
+		os.Remove(stateFile)
+	} else {
+		writeState(stateFile, newSt)
+	}
+	fmt.Println(visible)
+}
+
+// Render computes the marquee's next visible slice for text given the
+// previous tick's state, and returns the state to persist for the next
+// tick. It reads and writes no files and prints nothing (its only outside
+// call is resolveWidth's tmux query for a percentage or tmux-format width),
+// which lets both the one-shot CLI mode and the daemon's per-tick loop share
+// the same scrolling logic. When the
+// marquee isn't scrolling (the text was empty or fit within width), the
+// returned state carries forward only whatever tmuxVal/tmuxAt resolveWidth
+// cached — not a scroll position or hash — so a percentage or tmux-format
+// width spec stays cached across ticks even while the status item doesn't
+// need to scroll; a caller that drops its persisted state only when Render
+// returns a bare state{} therefore keeps that cached width.
+func Render(o opts, text string, st state) (string, state) {
+	width := resolveWidth(o.width, o.widthReserve, o.tmuxPane, &st)
+	renderFn := rendererFor(o.output)
+	cachedWidth := state{tmuxVal: st.tmuxVal, tmuxAt: st.tmuxAt}
+
+	text = ansiToTmux(text)
+	if o.normalize {
+		text = norm.NFC.String(text)
+	}
 	if o.maxLength > 0 {
 		text = truncateRunes(text, o.maxLength)
 	}
 
 	if text == "" {
-		os.Remove(stateFile)
-		fmt.Println("")
-		return
+		return "", cachedWidth
 	}
 
-	tokens := tokenize(text)
-	textCols := textWidth(tokens)
+	segs := parseStyled(text)
+	textCols := textWidthSegments(segs)
 
-	if textCols <= o.width {
+	if textCols <= width {
 		if o.pad {
-			padCount := o.width - textCols
-			fmt.Println(text + strings.Repeat(" ", padCount))
-		} else {
-			fmt.Println(text)
+			return renderFn(padSegments(segs, width-textCols)), cachedWidth
 		}
-		os.Remove(stateFile)
-		return
+		return renderFn(segs), cachedWidth
 	}
 
-	hash := contentHash(tokens)
-	st := readState(stateFile)
+	hash := contentHashSegments(segs)
 	if st.hash != hash {
-		st = state{hash: hash}
+		st.hash = hash
+		st.pos = 0
+		st.delayCounter = 0
 	}
 
 	// Scroll delay
 	if o.scrollDelay > 0 && st.delayCounter < o.scrollDelay {
 		st.delayCounter++
-		writeState(stateFile, state{hash: hash, pos: 0, delayCounter: st.delayCounter})
-		fmt.Println(sliceColumns(tokens, textCols, 0, o.width))
-		return
+		st.pos = 0
+		return renderFn(sliceSegments(segs, textCols, 0, width)), st
 	}
 
 	scrollText := text + o.separator
-	scrollTokens := tokenize(scrollText)
-	scrollCols := textWidth(scrollTokens)
+	scrollSegs := parseStyled(scrollText)
+	scrollCols := textWidthSegments(scrollSegs)
 	if scrollCols == 0 {
-		fmt.Println("")
-		return
+		return "", st
 	}
 
 	pos := st.pos % scrollCols
@@ -163,7 +248,7 @@ func main() {
 
 	switch o.direction {
 	case "bounce":
-		bounceRange := textCols - o.width
+		bounceRange := textCols - width
 		if bounceRange <= 0 {
 			bounceRange = 1
 		}
@@ -172,136 +257,110 @@ func main() {
 		if bouncePos >= bounceRange {
 			bouncePos = cycle - bouncePos
 		}
-		visible = sliceColumns(tokens, textCols, bouncePos, o.width)
+		visible = renderFn(sliceSegments(segs, textCols, bouncePos, width))
 		nextPos = pos + o.speed
 
 	case "right":
 		rpos := (scrollCols - pos%scrollCols) % scrollCols
-		visible = sliceColumns(scrollTokens, scrollCols, rpos, o.width)
+		visible = renderFn(sliceSegments(scrollSegs, scrollCols, rpos, width))
 		nextPos = pos + o.speed
 
 	default: // left
-		visible = sliceColumns(scrollTokens, scrollCols, pos, o.width)
+		visible = renderFn(sliceSegments(scrollSegs, scrollCols, pos, width))
 		nextPos = pos + o.speed
 	}
 
-	writeState(stateFile, state{hash: hash, pos: nextPos, delayCounter: st.delayCounter})
-	fmt.Println(visible)
+	st.pos = nextPos
+	return visible, st
 }
 
-func tokenize(s string) []token {
-	var tokens []token
-	i := 0
-	runes := []rune(s)
-	n := len(runes)
-	for i < n {
-		if i+1 < n && runes[i] == '#' && runes[i+1] == '[' {
-			end := -1
-			for j := i + 2; j < n; j++ {
-				if runes[j] == ']' {
-					end = j
-					break
-				}
-			}
-			if end >= 0 {
-				tag := string(runes[i : end+1])
-				tokens = append(tokens, token{style: true, text: tag})
-				i = end + 1
-				continue
-			}
-		}
-		r := runes[i]
-		w := runewidth.RuneWidth(r)
-		tokens = append(tokens, token{text: string(r), width: w})
-		i++
+// padSegments appends n columns of trailing spaces to segs, carrying the
+// last segment's style forward rather than resetting it — the same
+// no-explicit-reset behavior the old string-concatenation padding had, so
+// padding doesn't visually cut off a still-active background color early.
+func padSegments(segs []segment, n int) []segment {
+	if n <= 0 {
+		return segs
 	}
-	return tokens
-}
-
-func textWidth(tokens []token) int {
-	w := 0
-	for _, t := range tokens {
-		if !t.style {
-			w += t.width
-		}
+	var padStyle styleState
+	if len(segs) > 0 {
+		padStyle = segs[len(segs)-1].style
 	}
-	return w
+	return append(append([]segment{}, segs...), segment{style: padStyle, text: strings.Repeat(" ", n), width: n})
 }
 
-func contentHash(tokens []token) string {
-	var sb strings.Builder
-	for _, t := range tokens {
-		if !t.style {
-			sb.WriteString(t.text)
+// resolveWidth interprets an opts.width spec, which may be a plain column
+// count, a percentage of the tmux client width (e.g. "50%"), or a tmux
+// format string (e.g. "#{client_width}"). Percentage and format-string
+// specs are resolved by shelling out to `tmux display-message` against
+// pane, with the result cached briefly in st so that a transient tmux
+// failure falls back to the last-known value instead of collapsing the
+// marquee to zero width.
+func resolveWidth(spec string, reserve int, pane string, st *state) int {
+	spec = strings.TrimSpace(spec)
+	if n, err := strconv.Atoi(spec); err == nil {
+		return n
+	}
+	if strings.HasSuffix(spec, "%") {
+		n, err := strconv.Atoi(strings.TrimSuffix(spec, "%"))
+		if err != nil {
+			return st.tmuxVal
 		}
+		clientWidth := queryTmuxCached(st, pane, "#{client_width}")
+		w := clientWidth*n/100 - reserve
+		if w < 0 {
+			w = 0
+		}
+		return w
 	}
-	h := crc32.ChecksumIEEE([]byte(sb.String()))
-	return strconv.FormatUint(uint64(h), 10)
-}
-
-func sliceColumns(tokens []token, totalCols, offset, width int) string {
-	if totalCols == 0 {
-		return ""
+	if strings.Contains(spec, "#{") {
+		return queryTmuxCached(st, pane, spec)
 	}
-	offset = offset % totalCols
+	return st.tmuxVal
+}
 
-	// Build column positions for each token
-	type positioned struct {
-		tok token
-		col int
+// queryTmuxCached resolves a tmux format string via `tmux display-message`,
+// reusing the value cached in st for widthCacheTTL to avoid forking tmux on
+// every tick. On error (e.g. not running inside tmux, or a transient
+// failure) it falls back to the previously cached value.
+func queryTmuxCached(st *state, pane, format string) int {
+	now := time.Now().Unix()
+	if st.tmuxAt != 0 && now-st.tmuxAt < int64(widthCacheTTL.Seconds()) {
+		return st.tmuxVal
 	}
-	var pts []positioned
-	col := 0
-	for _, t := range tokens {
-		pts = append(pts, positioned{tok: t, col: col})
-		if !t.style {
-			col += t.width
-		}
+	val, err := queryTmux(pane, format)
+	if err != nil {
+		return st.tmuxVal
 	}
+	st.tmuxVal = val
+	st.tmuxAt = now
+	return val
+}
 
-	// Collect style preamble: all style tags at or before offset
-	var out strings.Builder
-	for _, p := range pts {
-		if p.tok.style && p.col <= offset {
-			out.WriteString(p.tok.text)
-		} else if !p.tok.style && p.col >= offset {
-			break
-		}
+// queryTmux asks tmux to resolve format against pane — the calling client's
+// $TMUX_PANE in one-shot mode, or the pane supplied over the wire in
+// --client/daemon mode, since the daemon process's own environment reflects
+// whichever pane happened to auto-spawn it, not the pane issuing this tick.
+func queryTmux(pane, format string) (int, error) {
+	cmd := exec.Command("tmux", "display-message", "-p", "-t", pane, format)
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, err
 	}
-
-	// Find first char token at or after offset
-	startIdx := 0
-	for i, p := range pts {
-		if !p.tok.style && p.col >= offset {
-			startIdx = i
-			break
-		}
+	n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
-	// Collect visible output with wrap-around
-	filled := 0
-	n := len(pts)
-	idx := startIdx
-	for laps := 0; filled < width && laps < 3; laps++ {
-		for idx < n && filled < width {
-			p := pts[idx]
-			if p.tok.style {
-				out.WriteString(p.tok.text)
-				idx++
-				continue
-			}
-			if filled+p.tok.width > width {
-				out.WriteByte(' ')
-				filled = width
-				break
-			}
-			out.WriteString(p.tok.text)
-			filled += p.tok.width
-			idx++
-		}
-		idx = 0
-	}
-	return out.String()
+const zeroWidthJoiner = '\u200D' // ZWJ
+
+// isCombiningMark reports whether r is a zero-width combining mark or
+// variation selector that should be folded into the preceding base rune's
+// segment rather than counted as a column of its own.
+func isCombiningMark(r rune) bool {
+	return unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || r == '\uFE0E' || r == '\uFE0F'
 }
 
 func stateDirectory() string {
@@ -325,12 +384,17 @@ func readState(path string) state {
 	}
 	pos, _ := strconv.Atoi(lines[1])
 	dc, _ := strconv.Atoi(lines[2])
-	return state{hash: lines[0], pos: pos, delayCounter: dc}
+	s := state{hash: lines[0], pos: pos, delayCounter: dc}
+	if len(lines) >= 5 {
+		s.tmuxVal, _ = strconv.Atoi(lines[3])
+		s.tmuxAt, _ = strconv.ParseInt(lines[4], 10, 64)
+	}
+	return s
 }
 
 func writeState(path string, s state) {
 	tmp := path + ".tmp." + strconv.Itoa(os.Getpid())
-	content := fmt.Sprintf("%s\n%d\n%d\n", s.hash, s.pos, s.delayCounter)
+	content := fmt.Sprintf("%s\n%d\n%d\n%d\n%d\n", s.hash, s.pos, s.delayCounter, s.tmuxVal, s.tmuxAt)
 	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
 		return
 	}
@@ -376,9 +440,12 @@ func ansiToTmux(s string) string {
 	i := 0
 	for i < len(s) {
 		if i+1 < len(s) && s[i] == '\x1b' && s[i+1] == '[' {
-			// Find end of CSI sequence
+			// Find end of CSI sequence. Colons separate SGR sub-params
+			// (e.g. 38:2:R:G:B) and 0x20-0x2F are CSI intermediate bytes;
+			// both must be consumed here so a malformed sequence doesn't
+			// end the scan early and swallow the text that follows it.
 			j := i + 2
-			for j < len(s) && ((s[j] >= '0' && s[j] <= '9') || s[j] == ';') {
+			for j < len(s) && ((s[j] >= '0' && s[j] <= '9') || s[j] == ';' || s[j] == ':' || (s[j] >= 0x20 && s[j] <= 0x2f)) {
 				j++
 			}
 			if j < len(s) && s[j] == 'm' {
@@ -407,13 +474,41 @@ func ansiToTmux(s string) string {
 }
 
 func sgrToTmux(params string) string {
-	if params == "" || params == "0" {
+	// A bare "\x1b[m" carries no parameters at all, which is a full reset;
+	// tmux has no single "reset" attribute tag, so spell out both layers.
+	if params == "" {
+		return "fg=default,bg=default"
+	}
+	if params == "0" {
 		return "default"
 	}
 	codes := strings.Split(params, ";")
 	var attrs []string
 	for ci := 0; ci < len(codes); ci++ {
-		n, err := strconv.Atoi(codes[ci])
+		code := codes[ci]
+		if code == "" {
+			// An empty parameter inside a sequence (e.g. "\x1b[;31m") is
+			// implicitly 0.
+			code = "0"
+		}
+		if strings.Contains(code, ":") {
+			parts := strings.Split(code, ":")
+			base, err := strconv.Atoi(parts[0])
+			if err != nil {
+				continue
+			}
+			layer := "fg"
+			if base == 48 {
+				layer = "bg"
+			}
+			if base == 38 || base == 48 {
+				if a := parseExtendedColorColon(layer, parts[1:]); a != "" {
+					attrs = append(attrs, a)
+				}
+			}
+			continue
+		}
+		n, err := strconv.Atoi(code)
 		if err != nil {
 			continue
 		}
@@ -428,16 +523,22 @@ func sgrToTmux(params string) string {
 			attrs = append(attrs, "italics")
 		case n == 4:
 			attrs = append(attrs, "underscore")
+		case n == 5 || n == 6:
+			attrs = append(attrs, "blink")
 		case n == 7:
 			attrs = append(attrs, "reverse")
 		case n == 9:
 			attrs = append(attrs, "strikethrough")
+		case n == 21:
+			attrs = append(attrs, "double-underscore")
 		case n == 22:
 			attrs = append(attrs, "nobold", "nodim")
 		case n == 23:
 			attrs = append(attrs, "noitalics")
 		case n == 24:
 			attrs = append(attrs, "nounderscore")
+		case n == 25:
+			attrs = append(attrs, "noblink")
 		case n == 27:
 			attrs = append(attrs, "noreverse")
 		case n == 29:
@@ -460,6 +561,10 @@ func sgrToTmux(params string) string {
 			}
 		case n == 49:
 			attrs = append(attrs, "bg=default")
+		case n == 53:
+			attrs = append(attrs, "overline")
+		case n == 55:
+			attrs = append(attrs, "nooverline")
 		case n >= 90 && n <= 97:
 			attrs = append(attrs, "fg=bright"+ansiColors[n-90])
 		case n >= 100 && n <= 107:
@@ -493,6 +598,37 @@ func parseExtendedColor(layer string, rest []string) (string, int) {
 	return "", 1
 }
 
+// parseExtendedColorColon handles the colon-delimited extended-color forms
+// (38:5:N and 38:2:R:G:B, with an optional empty colorspace-id field as in
+// 38:2::R:G:B), self-contained within a single colon-joined SGR sub-param
+// rather than spread across semicolon-separated codes.
+func parseExtendedColorColon(layer string, rest []string) string {
+	if len(rest) < 1 {
+		return ""
+	}
+	mode, _ := strconv.Atoi(rest[0])
+	switch mode {
+	case 5: // 38:5:N
+		if len(rest) < 2 {
+			return ""
+		}
+		return layer + "=colour" + rest[1]
+	case 2: // 38:2:R:G:B or 38:2::R:G:B (empty colorspace id)
+		rgb := rest[1:]
+		if len(rgb) == 4 && rgb[0] == "" {
+			rgb = rgb[1:]
+		}
+		if len(rgb) < 3 {
+			return ""
+		}
+		r, _ := strconv.Atoi(rgb[0])
+		g, _ := strconv.Atoi(rgb[1])
+		b, _ := strconv.Atoi(rgb[2])
+		return fmt.Sprintf("%s=#%02x%02x%02x", layer, r, g, b)
+	}
+	return ""
+}
+
 func mustInt(s string) int {
 	v, err := strconv.Atoi(s)
 	if err != nil {
@@ -508,7 +644,11 @@ func printUsage() {
 Usage: echo "long text" | tmux-marquee [OPTIONS]
 
 Options:
-  -w, --width N        Display width in columns (default: 30)
+  -w, --width N        Display width: a column count, a percentage of the
+                       tmux client width (e.g. "50%"), or a tmux format
+                       string (e.g. "#{client_width}") (default: 30)
+  --width-reserve N    Columns to subtract from a percentage width, for
+                       other status-right items (default: 0)
   -i, --id NAME        Instance ID for independent state (default: "default")
   -s, --speed N        Characters to advance per tick (default: 1)
   --separator STR      Text between loop iterations (default: " - ")
@@ -517,10 +657,22 @@ Options:
   --no-pad             Don't pad short text
   --scroll-delay N     Wait N ticks before starting scroll (default: 0)
   --max-length N       Truncate input beyond N chars (0 = unlimited)
+  --normalize          Normalize input to NFC before scrolling (default)
+  --literal            Disable normalization for byte-exact pass-through
+  --output FORMAT      Output format: tmux, ansi, plain, zellij (default: tmux)
   --reset              Clear state for this ID and exit
   --help               Show this help
   --version            Show version
 
+Daemon mode (avoids forking a full process per tick):
+  --daemon             Run as a background daemon, listening on --socket
+  --client             Forward this invocation to the daemon, auto-spawning
+                       it if --socket is not reachable
+  --daemon-stop        Ask a running daemon to flush state and exit
+  --daemon-status      Report whether the daemon is reachable
+  --socket PATH        Daemon socket path (default: $XDG_RUNTIME_DIR/tmux-marquee/sock)
+  --interval DUR       Daemon tick interval, e.g. "250ms" (default: 1s)
+
 Examples:
   # Basic scrolling in tmux status bar
   set -g status-right '#(my-cmd | tmux-marquee -w 30 -i sr)'
@@ -528,7 +680,16 @@ Examples:
   # Use tmux's client width
   set -g status-right '#(my-cmd | tmux-marquee -w #{client_width} -i sr)'
 
+  # Scale with the client width, leaving room for the clock
+  set -g status-right '#(my-cmd | tmux-marquee -w 50% --width-reserve 10 -i sr) %H:%M'
+
+  # Offload per-tick work to a daemon ticking faster than status-interval
+  set -g status-right '#(my-cmd | tmux-marquee --client -w 30 -s 2 -i sr)'
+
   # Multiple independent marquees
   set -g status-right '#(cmd1 | tmux-marquee -w 20 -i a) #(cmd2 | tmux-marquee -w 20 -i b)'
+
+  # Pipe into a non-tmux consumer instead of tmux's #[...] tags
+  my-cmd | tmux-marquee -w 40 --output ansi | less -R
 `)
 }
@@ -0,0 +1,102 @@
+package main
+
+import "testing"
+
+func TestParseStyledPlainASCII(t *testing.T) {
+	segs := parseStyled("hi")
+	if len(segs) != 2 {
+		t.Fatalf("len(segs) = %d, want 2", len(segs))
+	}
+	for i, want := range []string{"h", "i"} {
+		if segs[i].text != want {
+			t.Errorf("segs[%d].text = %q, want %q", i, segs[i].text, want)
+		}
+		if segs[i].width != 1 {
+			t.Errorf("segs[%d].width = %d, want 1", i, segs[i].width)
+		}
+	}
+}
+
+func TestParseStyledCombiningMarkFusesIntoBaseRune(t *testing.T) {
+	// "e" followed by a combining acute accent (U+0301) is one grapheme
+	// cluster and must not be split into two segments.
+	in := "éllo"
+	segs := parseStyled(in)
+	if len(segs) != 4 {
+		t.Fatalf("len(segs) = %d, want 4: %+v", len(segs), segs)
+	}
+	if segs[0].text != "é" {
+		t.Errorf("segs[0].text = %q, want %q", segs[0].text, "é")
+	}
+	if segs[0].width != 1 {
+		t.Errorf("segs[0].width = %d, want 1", segs[0].width)
+	}
+	for i, want := range []string{"l", "l", "o"} {
+		if segs[i+1].text != want {
+			t.Errorf("segs[%d].text = %q, want %q", i+1, segs[i+1].text, want)
+		}
+	}
+}
+
+func TestParseStyledZeroWidthJoinerFusesSequenceIntoOneSegment(t *testing.T) {
+	// A ZWJ-joined sequence is a single grapheme cluster; its on-screen
+	// width is taken from the leading rune only, matching how a tmux
+	// status line actually renders it as one cell cluster.
+	in := "a‍b"
+	segs := parseStyled(in)
+	if len(segs) != 1 {
+		t.Fatalf("len(segs) = %d, want 1: %+v", len(segs), segs)
+	}
+	if segs[0].text != in {
+		t.Errorf("segs[0].text = %q, want %q", segs[0].text, in)
+	}
+	if segs[0].width != 1 {
+		t.Errorf("segs[0].width = %d, want 1", segs[0].width)
+	}
+}
+
+func TestParseStyledMultipleZeroWidthJoiners(t *testing.T) {
+	in := "a‍b‍c"
+	segs := parseStyled(in)
+	if len(segs) != 1 {
+		t.Fatalf("len(segs) = %d, want 1: %+v", len(segs), segs)
+	}
+	if segs[0].text != in {
+		t.Errorf("segs[0].text = %q, want %q", segs[0].text, in)
+	}
+}
+
+func TestParseStyledTmuxTagChangesStyleWithoutEmittingSegment(t *testing.T) {
+	segs := parseStyled("#[fg=red]hi#[default]lo")
+	if len(segs) != 4 {
+		t.Fatalf("len(segs) = %d, want 4: %+v", len(segs), segs)
+	}
+	for i, want := range []string{"h", "i"} {
+		if segs[i].text != want {
+			t.Errorf("segs[%d].text = %q, want %q", i, segs[i].text, want)
+		}
+		if segs[i].style.fg != "red" {
+			t.Errorf("segs[%d].style.fg = %q, want %q", i, segs[i].style.fg, "red")
+		}
+	}
+	for i, want := range []string{"l", "o"} {
+		seg := segs[i+2]
+		if seg.text != want {
+			t.Errorf("segs[%d].text = %q, want %q", i+2, seg.text, want)
+		}
+		if seg.style != (styleState{}) {
+			t.Errorf("segs[%d].style = %+v, want zero value after #[default]", i+2, seg.style)
+		}
+	}
+}
+
+func TestParseStyledUnterminatedTagTreatedAsLiteralText(t *testing.T) {
+	segs := parseStyled("#[fg=red")
+	var got string
+	for _, s := range segs {
+		got += s.text
+	}
+	if got != "#[fg=red" {
+		t.Errorf("parseStyled unterminated tag reassembled = %q, want %q", got, "#[fg=red")
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+// styleState is the fully-resolved set of display attributes in effect at a
+// point in the text, after applying every tag or escape sequence seen so
+// far. Segments carry a styleState snapshot rather than a diff, so each
+// output renderer is free to compute its own transitions (or none at all).
+type styleState struct {
+	fg, bg        string
+	bold          bool
+	dim           bool
+	italics       bool
+	underscore    bool
+	doubleUnder   bool
+	blink         bool
+	reverse       bool
+	strikethrough bool
+	overline      bool
+}
+
+// segment is one grapheme cluster of visible text tagged with the style in
+// effect when it appears. This is the typed IR that sliceSegments and every
+// renderer operate on, replacing the old token stream that mixed raw tag
+// strings and literal text in the same slice.
+type segment struct {
+	style styleState
+	text  string
+	width int
+}
+
+// parseStyled walks text that has already been through ansiToTmux (so any
+// raw ANSI SGR sequences are already normalized to #[...] tags) and produces
+// one segment per grapheme cluster, each carrying the cumulative styleState
+// at that point. A cluster is a base rune plus any trailing combining marks
+// (see isCombiningMark) and any ZWJ-joined runes; its width is the base
+// rune's width.
+func parseStyled(s string) []segment {
+	var segs []segment
+	var cur styleState
+	runes := []rune(s)
+	n := len(runes)
+	i := 0
+	for i < n {
+		if i+1 < n && runes[i] == '#' && runes[i+1] == '[' {
+			end := -1
+			for j := i + 2; j < n; j++ {
+				if runes[j] == ']' {
+					end = j
+					break
+				}
+			}
+			if end >= 0 {
+				applyTmuxTag(&cur, string(runes[i+2:end]))
+				i = end + 1
+				continue
+			}
+		}
+		start := i
+		w := runewidth.RuneWidth(runes[i])
+		i++
+		for i < n && isCombiningMark(runes[i]) {
+			i++
+		}
+		for i+1 < n && runes[i] == zeroWidthJoiner {
+			i += 2
+			for i < n && isCombiningMark(runes[i]) {
+				i++
+			}
+		}
+		segs = append(segs, segment{style: cur, text: string(runes[start:i]), width: w})
+	}
+	return segs
+}
+
+// applyTmuxTag mutates st according to a tmux #[...] tag's comma-separated
+// attribute list — the same vocabulary sgrToTmux emits: "default" (full
+// reset), "fg=X"/"bg=X", and bare attribute names with a "no" prefix to
+// clear them.
+func applyTmuxTag(st *styleState, attrs string) {
+	for _, a := range strings.Split(attrs, ",") {
+		a = strings.TrimSpace(a)
+		switch {
+		case a == "":
+			continue
+		case a == "default":
+			*st = styleState{}
+		case strings.HasPrefix(a, "fg="):
+			st.fg = strings.TrimPrefix(a, "fg=")
+		case strings.HasPrefix(a, "bg="):
+			st.bg = strings.TrimPrefix(a, "bg=")
+		case a == "bold":
+			st.bold = true
+		case a == "nobold":
+			st.bold = false
+		case a == "dim":
+			st.dim = true
+		case a == "nodim":
+			st.dim = false
+		case a == "italics":
+			st.italics = true
+		case a == "noitalics":
+			st.italics = false
+		case a == "underscore":
+			st.underscore = true
+		case a == "double-underscore":
+			st.doubleUnder = true
+		case a == "nounderscore":
+			st.underscore = false
+			st.doubleUnder = false
+		case a == "blink":
+			st.blink = true
+		case a == "noblink":
+			st.blink = false
+		case a == "reverse":
+			st.reverse = true
+		case a == "noreverse":
+			st.reverse = false
+		case a == "strikethrough":
+			st.strikethrough = true
+		case a == "nostrikethrough":
+			st.strikethrough = false
+		case a == "overline":
+			st.overline = true
+		case a == "nooverline":
+			st.overline = false
+		}
+	}
+}
+
+func textWidthSegments(segs []segment) int {
+	w := 0
+	for _, s := range segs {
+		w += s.width
+	}
+	return w
+}
+
+func contentHashSegments(segs []segment) string {
+	var sb strings.Builder
+	for _, s := range segs {
+		sb.WriteString(s.text)
+	}
+	h := crc32.ChecksumIEEE([]byte(sb.String()))
+	return strconv.FormatUint(uint64(h), 10)
+}
+
+// sliceSegments returns the segments visible in the width-wide window
+// starting at offset within a totalCols-wide ring buffer, wrapping around up
+// to twice so a window can straddle the loop boundary. It carries style
+// metadata through unchanged; turning the result into output text is each
+// renderer's job.
+func sliceSegments(segs []segment, totalCols, offset, width int) []segment {
+	if totalCols == 0 || width <= 0 {
+		return nil
+	}
+	offset = offset % totalCols
+
+	startIdx := len(segs)
+	col := 0
+	for i, s := range segs {
+		if col >= offset {
+			startIdx = i
+			break
+		}
+		col += s.width
+	}
+
+	var out []segment
+	filled := 0
+	n := len(segs)
+	idx := startIdx
+	for laps := 0; filled < width && laps < 3; laps++ {
+		for idx < n && filled < width {
+			s := segs[idx]
+			if filled+s.width > width {
+				out = append(out, segment{style: s.style, text: " ", width: 1})
+				filled = width
+				break
+			}
+			out = append(out, s)
+			filled += s.width
+			idx++
+		}
+		idx = 0
+	}
+	return out
+}
+
+// rendererFor resolves an --output flag value to the function that turns a
+// slice of segments into the bytes written to stdout. Unrecognised values
+// fall back to tmux, the original (and still default) output format.
+func rendererFor(kind string) func([]segment) string {
+	switch kind {
+	case "ansi":
+		return renderANSI
+	case "plain":
+		return renderPlain
+	case "zellij":
+		return renderZellij
+	default:
+		return renderTmux
+	}
+}
+
+// renderPlain discards all styling and concatenates segment text, for
+// piping into tools (e.g. `watch`) that don't understand any style markup.
+func renderPlain(segs []segment) string {
+	var sb strings.Builder
+	for _, s := range segs {
+		sb.WriteString(s.text)
+	}
+	return sb.String()
+}
+
+// renderTmux re-emits segments as tmux #[...] tags, the original output
+// format: a tag is only written when a segment's style differs from the one
+// before it.
+func renderTmux(segs []segment) string {
+	var sb strings.Builder
+	var prev styleState
+	have := false
+	for _, s := range segs {
+		if !have || s.style != prev {
+			if attrs := tmuxAttrs(prev, s.style, have); attrs != "" {
+				sb.WriteString("#[")
+				sb.WriteString(attrs)
+				sb.WriteByte(']')
+			}
+			prev = s.style
+			have = true
+		}
+		sb.WriteString(s.text)
+	}
+	return sb.String()
+}
+
+// renderANSI re-emits segments as raw ANSI SGR escape sequences, for piping
+// tmux-marquee's output into status bars (or terminals) that read ANSI
+// directly instead of tmux's #[...] tags.
+func renderANSI(segs []segment) string {
+	var sb strings.Builder
+	var prev styleState
+	have := false
+	for _, s := range segs {
+		if !have || s.style != prev {
+			if codes := ansiCodes(prev, s.style, have); len(codes) > 0 {
+				sb.WriteString("\x1b[")
+				sb.WriteString(strings.Join(codes, ";"))
+				sb.WriteByte('m')
+			}
+			prev = s.style
+			have = true
+		}
+		sb.WriteString(s.text)
+	}
+	if have && prev != (styleState{}) {
+		sb.WriteString("\x1b[0m")
+	}
+	return sb.String()
+}
+
+// renderZellij emits the same SGR sequences as renderANSI. Unlike a tmux
+// status line, a zellij plugin pane's canvas persists attributes across
+// redraws rather than resetting between frames, so the trailing reset is
+// written unconditionally — otherwise a styled marquee would bleed color
+// into whatever the plugin draws next to it.
+func renderZellij(segs []segment) string {
+	var sb strings.Builder
+	var prev styleState
+	have := false
+	for _, s := range segs {
+		if !have || s.style != prev {
+			if codes := ansiCodes(prev, s.style, have); len(codes) > 0 {
+				sb.WriteString("\x1b[")
+				sb.WriteString(strings.Join(codes, ";"))
+				sb.WriteByte('m')
+			}
+			prev = s.style
+			have = true
+		}
+		sb.WriteString(s.text)
+	}
+	sb.WriteString("\x1b[0m")
+	return sb.String()
+}
+
+// tmuxAttrs returns the tmux #[...] attribute list needed to move from prev
+// to cur, only naming attributes that actually changed so a renderer never
+// resets properties the caller didn't touch.
+func tmuxAttrs(prev, cur styleState, havePrev bool) string {
+	if cur == (styleState{}) {
+		if havePrev && prev != cur {
+			return "default"
+		}
+		return ""
+	}
+	var attrs []string
+	if cur.fg != prev.fg {
+		if cur.fg == "" {
+			attrs = append(attrs, "fg=default")
+		} else {
+			attrs = append(attrs, "fg="+cur.fg)
+		}
+	}
+	if cur.bg != prev.bg {
+		if cur.bg == "" {
+			attrs = append(attrs, "bg=default")
+		} else {
+			attrs = append(attrs, "bg="+cur.bg)
+		}
+	}
+	addTmuxBool(&attrs, cur.bold, prev.bold, "bold", "nobold")
+	addTmuxBool(&attrs, cur.dim, prev.dim, "dim", "nodim")
+	addTmuxBool(&attrs, cur.italics, prev.italics, "italics", "noitalics")
+	if cur.underscore != prev.underscore || cur.doubleUnder != prev.doubleUnder {
+		switch {
+		case cur.doubleUnder:
+			attrs = append(attrs, "double-underscore")
+		case cur.underscore:
+			attrs = append(attrs, "underscore")
+		default:
+			attrs = append(attrs, "nounderscore")
+		}
+	}
+	addTmuxBool(&attrs, cur.blink, prev.blink, "blink", "noblink")
+	addTmuxBool(&attrs, cur.reverse, prev.reverse, "reverse", "noreverse")
+	addTmuxBool(&attrs, cur.strikethrough, prev.strikethrough, "strikethrough", "nostrikethrough")
+	addTmuxBool(&attrs, cur.overline, prev.overline, "overline", "nooverline")
+	return strings.Join(attrs, ",")
+}
+
+func addTmuxBool(attrs *[]string, cur, prev bool, onName, offName string) {
+	if cur == prev {
+		return
+	}
+	if cur {
+		*attrs = append(*attrs, onName)
+	} else {
+		*attrs = append(*attrs, offName)
+	}
+}
+
+// ansiCodes returns the SGR codes needed to move from prev to cur, mirroring
+// tmuxAttrs but in ANSI's numeric vocabulary instead of tmux's named one.
+func ansiCodes(prev, cur styleState, havePrev bool) []string {
+	if cur == (styleState{}) {
+		if havePrev && prev != cur {
+			return []string{"0"}
+		}
+		return nil
+	}
+	var codes []string
+	if cur.fg != prev.fg {
+		codes = append(codes, ansiColorCodes("fg", cur.fg)...)
+	}
+	if cur.bg != prev.bg {
+		codes = append(codes, ansiColorCodes("bg", cur.bg)...)
+	}
+	addAnsiBool := func(cur, prev bool, on, off string) {
+		if cur == prev {
+			return
+		}
+		if cur {
+			codes = append(codes, on)
+		} else {
+			codes = append(codes, off)
+		}
+	}
+	// 22 clears both bold and dim, and 24 clears both underline styles, so
+	// after either reset the attribute cur still has is switched back on.
+	if (prev.bold && !cur.bold) || (prev.dim && !cur.dim) {
+		codes = append(codes, "22")
+		prev.bold, prev.dim = false, false
+	}
+	if (prev.underscore && !cur.underscore) || (prev.doubleUnder && !cur.doubleUnder) {
+		codes = append(codes, "24")
+		prev.underscore, prev.doubleUnder = false, false
+	}
+	addAnsiBool(cur.bold, prev.bold, "1", "22")
+	addAnsiBool(cur.dim, prev.dim, "2", "22")
+	addAnsiBool(cur.italics, prev.italics, "3", "23")
+	addAnsiBool(cur.underscore, prev.underscore, "4", "24")
+	addAnsiBool(cur.doubleUnder, prev.doubleUnder, "21", "24")
+	addAnsiBool(cur.blink, prev.blink, "5", "25")
+	addAnsiBool(cur.reverse, prev.reverse, "7", "27")
+	addAnsiBool(cur.strikethrough, prev.strikethrough, "9", "29")
+	addAnsiBool(cur.overline, prev.overline, "53", "55")
+	return codes
+}
+
+// ansiColorCodes converts a tmux-vocabulary color value (as produced by
+// sgrToTmux: "default"/"", a base color name, "brightNAME", "colourN", or
+// "#rrggbb") into the SGR code(s) that set it on the given layer.
+func ansiColorCodes(layer, val string) []string {
+	defaultCode, baseOffset, brightOffset, extCode := "39", 30, 90, "38"
+	if layer == "bg" {
+		defaultCode, baseOffset, brightOffset, extCode = "49", 40, 100, "48"
+	}
+	if val == "" || val == "default" {
+		return []string{defaultCode}
+	}
+	if strings.HasPrefix(val, "colour") {
+		return []string{extCode, "5", strings.TrimPrefix(val, "colour")}
+	}
+	if strings.HasPrefix(val, "#") && len(val) == 7 {
+		r, _ := strconv.ParseUint(val[1:3], 16, 8)
+		g, _ := strconv.ParseUint(val[3:5], 16, 8)
+		b, _ := strconv.ParseUint(val[5:7], 16, 8)
+		return []string{extCode, "2", strconv.FormatUint(r, 10), strconv.FormatUint(g, 10), strconv.FormatUint(b, 10)}
+	}
+	if name := strings.TrimPrefix(val, "bright"); name != val {
+		for idx, c := range ansiColors {
+			if c == name {
+				return []string{strconv.Itoa(brightOffset + idx)}
+			}
+		}
+	}
+	for idx, c := range ansiColors {
+		if c == val {
+			return []string{strconv.Itoa(baseOffset + idx)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+
+func TestAnsiToTmux(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain text", "hello", "hello"},
+		{"bare reset", "\x1b[mhi", "#[fg=default,bg=default]hi"},
+		{"full reset code", "\x1b[0mhi", "#[default]hi"},
+		{"empty leading param", "\x1b[;31mhi", "#[default,fg=red]hi"},
+		{"basic fg", "\x1b[31mred\x1b[0m", "#[fg=red]red#[default]"},
+		{"bright fg", "\x1b[91mred\x1b[0m", "#[fg=brightred]red#[default]"},
+		{"256-color semicolon", "\x1b[38;5;201mhi", "#[fg=colour201]hi"},
+		{"truecolor semicolon", "\x1b[38;2;10;20;30mhi", "#[fg=#0a141e]hi"},
+		{"256-color colon", "\x1b[38:5:201mhi", "#[fg=colour201]hi"},
+		{"truecolor colon", "\x1b[38:2:10:20:30mhi", "#[fg=#0a141e]hi"},
+		{"truecolor colon with colorspace id", "\x1b[38:2::10:20:30mhi", "#[fg=#0a141e]hi"},
+		{"bg 256-color colon", "\x1b[48:5:17mhi", "#[bg=colour17]hi"},
+		{"blink 5", "\x1b[5mhi", "#[blink]hi"},
+		{"blink 6 (rapid)", "\x1b[6mhi", "#[blink]hi"},
+		{"noblink", "\x1b[25mhi", "#[noblink]hi"},
+		{"overline", "\x1b[53mhi", "#[overline]hi"},
+		{"nooverline", "\x1b[55mhi", "#[nooverline]hi"},
+		{"double underscore", "\x1b[21mhi", "#[double-underscore]hi"},
+		{"nobold/nodim", "\x1b[22mhi", "#[nobold,nodim]hi"},
+		{"non-SGR CSI stripped", "\x1b[2Jhi", "hi"},
+		{"unterminated CSI stripped to end", "hi\x1b[31", "hi"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ansiToTmux(tc.in)
+			if got != tc.want {
+				t.Errorf("ansiToTmux(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSgrToTmux(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		want   string
+	}{
+		{"empty params (bare reset)", "", "fg=default,bg=default"},
+		{"zero (full reset)", "0", "default"},
+		{"bold", "1", "bold"},
+		{"italics", "3", "italics"},
+		{"underscore", "4", "underscore"},
+		{"strikethrough", "9", "strikethrough"},
+		{"nostrikethrough", "29", "nostrikethrough"},
+		{"basic bg", "42", "bg=green"},
+		{"bright bg", "104", "bg=brightblue"},
+		{"bg default", "49", "bg=default"},
+		{"combined bold + fg", "1;31", "bold,fg=red"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := sgrToTmux(tc.params)
+			if got != tc.want {
+				t.Errorf("sgrToTmux(%q) = %q, want %q", tc.params, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseExtendedColorColon(t *testing.T) {
+	cases := []struct {
+		name  string
+		layer string
+		rest  []string
+		want  string
+	}{
+		{"256-color", "fg", []string{"5", "201"}, "fg=colour201"},
+		{"truecolor", "bg", []string{"2", "10", "20", "30"}, "bg=#0a141e"},
+		{"truecolor with empty colorspace id", "fg", []string{"2", "", "10", "20", "30"}, "fg=#0a141e"},
+		{"truncated 256-color", "fg", []string{"5"}, ""},
+		{"truncated truecolor", "fg", []string{"2", "10", "20"}, ""},
+		{"unknown mode", "fg", []string{"9"}, ""},
+		{"empty rest", "fg", []string{}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseExtendedColorColon(tc.layer, tc.rest)
+			if got != tc.want {
+				t.Errorf("parseExtendedColorColon(%q, %v) = %q, want %q", tc.layer, tc.rest, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveWidthPlainColumnCount(t *testing.T) {
+	var st state
+	if got := resolveWidth(" 42 ", 0, "", &st); got != 42 {
+		t.Errorf("resolveWidth(%q) = %d, want 42", " 42 ", got)
+	}
+}
+
+func TestResolveWidthFallsBackToCachedValueOnTmuxFailure(t *testing.T) {
+	// No tmux session is running in this process, so queryTmux is
+	// guaranteed to fail regardless of pane/format; resolveWidth must
+	// fall back to whatever was last cached rather than collapsing to 0.
+	st := state{tmuxVal: 80}
+	if got := resolveWidth("#{client_width}", 0, "nonexistent-pane", &st); got != 80 {
+		t.Errorf("resolveWidth with failing tmux = %d, want cached 80", got)
+	}
+}
+
+func TestResolveWidthPercentFallsBackOnTmuxFailure(t *testing.T) {
+	st := state{tmuxVal: 80}
+	got := resolveWidth("50%", 0, "nonexistent-pane", &st)
+	// queryTmuxCached falls back to st.tmuxVal (80) for clientWidth, so
+	// the percentage math still runs: 80*50/100 - 0 = 40.
+	if want := 40; got != want {
+		t.Errorf("resolveWidth(%q) = %d, want %d", "50%", got, want)
+	}
+}
+
+func TestResolveWidthPercentInvalidNumber(t *testing.T) {
+	st := state{tmuxVal: 99}
+	if got := resolveWidth("abc%", 0, "", &st); got != 99 {
+		t.Errorf("resolveWidth(%q) = %d, want cached 99", "abc%", got)
+	}
+}
+
+func TestResolveWidthBareFormatFallsBackToCachedValue(t *testing.T) {
+	st := state{tmuxVal: 17}
+	if got := resolveWidth("not a number or format", 0, "", &st); got != 17 {
+		t.Errorf("resolveWidth with unrecognized spec = %d, want cached 17", got)
+	}
+}
+
+func TestQueryTmuxCachedReusesValueWithinTTL(t *testing.T) {
+	st := state{tmuxVal: 55, tmuxAt: time.Now().Unix()}
+	// tmuxAt is fresh, so queryTmuxCached must return the cached value
+	// without forking tmux at all, even with a bogus pane/format.
+	if got := queryTmuxCached(&st, "nonexistent-pane", "#{client_width}"); got != 55 {
+		t.Errorf("queryTmuxCached within TTL = %d, want cached 55", got)
+	}
+}
+
+func TestQueryTmuxCachedFallsBackOnError(t *testing.T) {
+	st := state{tmuxVal: 30, tmuxAt: 0}
+	got := queryTmuxCached(&st, "nonexistent-pane", "#{client_width}")
+	if got != 30 {
+		t.Errorf("queryTmuxCached on tmux failure = %d, want cached 30", got)
+	}
+	if st.tmuxAt != 0 {
+		t.Error("queryTmuxCached must not update tmuxAt on failure")
+	}
+}